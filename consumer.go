@@ -6,39 +6,158 @@ import (
 	"github.com/streadway/amqp"
 	"go.uber.org/zap"
 	"net"
+	"sync"
 	"time"
 )
 
+// ConsumerOptions controls acknowledgement mode and QoS (prefetch) settings
+// applied to a Consumer's channel.
+//
+// When AutoAck is false, deliveries are wrapped in a Delivery and the caller
+// must call Ack, Nack or Reject on it; if the caller takes longer than
+// AckTimeout to decide, the delivery is automatically Nack'd with requeue.
+// A zero or negative AckTimeout disables this and waits for the caller
+// indefinitely. AckTimeout is ignored when AutoAck is true.
+type ConsumerOptions struct {
+	AutoAck       bool
+	PrefetchCount int
+	PrefetchSize  int
+	Global        bool
+	AckTimeout    time.Duration
+}
+
+// DefaultConsumerOptions returns the options used by NewConsumer, preserving
+// the historical auto-ack, no-QoS behaviour.
+func DefaultConsumerOptions() ConsumerOptions {
+	return ConsumerOptions{
+		AutoAck: true,
+	}
+}
+
+// Delivery wraps an amqp.Delivery delivered in manual-ack mode, exposing
+// Ack, Nack and Reject so the caller controls when the message is settled.
+// Settled closes once one of those is called, letting awaitAck stop
+// waiting as soon as the caller decides instead of for the full
+// ConsumerOptions.AckTimeout.
+type Delivery struct {
+	amqp.Delivery
+	settled chan struct{}
+	once    sync.Once
+}
+
+func newDelivery(d amqp.Delivery) *Delivery {
+	return &Delivery{Delivery: d, settled: make(chan struct{})}
+}
+
+// Settled returns a channel that closes once Ack, Nack or Reject has been
+// called.
+func (d *Delivery) Settled() <-chan struct{} {
+	return d.settled
+}
+
+func (d *Delivery) settle() {
+	d.once.Do(func() { close(d.settled) })
+}
+
+// Ack acknowledges the delivery.
+func (d *Delivery) Ack() error {
+	defer d.settle()
+	return d.Delivery.Ack(false)
+}
+
+// Nack negatively acknowledges the delivery, optionally requeueing it.
+func (d *Delivery) Nack(requeue bool) error {
+	defer d.settle()
+	return d.Delivery.Nack(false, requeue)
+}
+
+// Reject rejects the delivery, optionally requeueing it.
+func (d *Delivery) Reject(requeue bool) error {
+	defer d.settle()
+	return d.Delivery.Reject(requeue)
+}
+
 type Consumer struct {
 	amqpURI        string
 	tls            *tls.Config
-	exchange       string
-	exchangeType   string
-	queue          string
-	routingKey     string
+	exchangeCfgs   []ExchangeConfig
+	queueCfg       QueueConfig
+	bindings       []Binding
 	ctag           string
+	options        ConsumerOptions
 	logger         *zap.SugaredLogger
 	client         *client
 	clientChanChan chan chan *client
-	sendChan       chan amqp.Delivery
+	manualChan     chan *Delivery
+	middlewares    []Middleware
+	handler        DeliveryHandler
 	cancel         context.CancelFunc
 	quit           chan struct{}
+	shutdownCtx    context.Context
+	shutdownDone   chan error
 }
 
+// NewConsumer is a thin wrapper around NewConsumerWithTopology for the
+// common case of one durable exchange, one durable queue and a single
+// binding between them, auto-acking with no QoS limit.
 func NewConsumer(amqpURI string, tls *tls.Config, exchange string, exchangeType string, queue string, key string,
 	ctag string, logger *zap.SugaredLogger) (*Consumer, chan amqp.Delivery, error) {
 
+	c, manualChan, err := newConsumer(amqpURI, tls, []ExchangeConfig{DefaultExchangeConfig(exchange, exchangeType)},
+		DefaultQueueConfig(queue), []Binding{{Exchange: exchange, RoutingKey: key}}, ctag, logger, DefaultConsumerOptions())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sendChan := make(chan amqp.Delivery)
+	go func() {
+		defer close(sendChan)
+		for d := range manualChan {
+			sendChan <- d.Delivery
+		}
+	}()
+	return c, sendChan, nil
+}
+
+// NewConsumerWithOptions is like NewConsumer but accepts a ConsumerOptions to
+// configure QoS (prefetch) and acknowledgement mode. Deliveries are always
+// returned on a *Delivery channel; when opts.AutoAck is false the caller is
+// responsible for acking, nacking or rejecting each one.
+func NewConsumerWithOptions(amqpURI string, tls *tls.Config, exchange string, exchangeType string, queue string,
+	key string, ctag string, logger *zap.SugaredLogger, opts ConsumerOptions) (*Consumer, chan *Delivery, error) {
+
+	return newConsumer(amqpURI, tls, []ExchangeConfig{DefaultExchangeConfig(exchange, exchangeType)}, DefaultQueueConfig(queue),
+		[]Binding{{Exchange: exchange, RoutingKey: key}}, ctag, logger, opts)
+}
+
+// NewConsumerWithTopology is the fully configurable constructor: exchangeCfgs
+// and queueCfg support passive declares and broker-specific Args (quorum
+// queues, dead-lettering, TTL, max length, ...), and bindings lets the
+// queue be bound to one or more exchange/routingKey pairs, as needed for
+// headers or topic exchanges. Every exchange named by a Binding must have a
+// matching entry in exchangeCfgs (by Name) — it is declared (or, if Passive,
+// checked) before the binding is made.
+func NewConsumerWithTopology(amqpURI string, tls *tls.Config, exchangeCfgs []ExchangeConfig, queueCfg QueueConfig,
+	bindings []Binding, ctag string, logger *zap.SugaredLogger, opts ConsumerOptions) (*Consumer, chan *Delivery, error) {
+
+	return newConsumer(amqpURI, tls, exchangeCfgs, queueCfg, bindings, ctag, logger, opts)
+}
+
+func newConsumer(amqpURI string, tls *tls.Config, exchangeCfgs []ExchangeConfig, queueCfg QueueConfig,
+	bindings []Binding, ctag string, logger *zap.SugaredLogger, opts ConsumerOptions) (*Consumer, chan *Delivery, error) {
+
 	c := &Consumer{
 		amqpURI:      amqpURI,
 		tls:          tls,
-		exchange:     exchange,
-		exchangeType: exchangeType,
-		queue:        queue,
-		routingKey:   key,
+		exchangeCfgs: exchangeCfgs,
+		queueCfg:     queueCfg,
+		bindings:     bindings,
 		ctag:         ctag,
+		options:      opts,
 		logger:       logger,
-		sendChan:     make(chan amqp.Delivery),
+		manualChan:   make(chan *Delivery),
 		quit:         make(chan struct{}),
+		shutdownDone: make(chan error, 1),
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -46,13 +165,25 @@ func NewConsumer(amqpURI string, tls *tls.Config, exchange string, exchangeType
 	c.clientChanChan = redialConsumer(ctx, c)
 
 	go c.handle()
-	return c, c.sendChan, nil
+	return c, c.manualChan, nil
 }
 
-func (c *Consumer) Shutdown() {
+// Shutdown stops the consumer gracefully: it cancels the server-side
+// consumer so no new deliveries arrive, drains whatever is still in flight
+// (see drain), closes the channel and then the connection. It returns the first non-nil
+// error encountered, or ctx.Err() if ctx expires before the drain finishes.
+func (c *Consumer) Shutdown(ctx context.Context) error {
 	c.logger.Warn("consumer received shutdown ...")
+	c.shutdownCtx = ctx
 	close(c.quit)
 	c.cancel()
+
+	select {
+	case err := <-c.shutdownDone:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (c *Consumer) handle() {
@@ -64,18 +195,29 @@ func (c *Consumer) handle() {
 			clientChan, ok := <-c.clientChanChan
 			if !ok {
 				c.logger.Errorf("cannot get a new client; channel is closed")
+				close(c.manualChan)
+				select {
+				case c.shutdownDone <- nil:
+				default:
+				}
 				return
 			}
 			c.client = <-clientChan
+			if err = c.client.channel.Qos(c.options.PrefetchCount, c.options.PrefetchSize, c.options.Global); err != nil {
+				c.logger.Errorf("set qos failed; error = %v", err)
+				_ = c.client.close()
+				c.client = nil
+				continue
+			}
 			c.logger.Debugf("queue bound to exchange, starting consume (consumer tag '%s')", c.ctag)
 			deliveries, err = c.client.channel.Consume(
-				c.queue, // name
-				c.ctag,  // consumerTag,
-				true,    // autoAck
-				false,   // exclusive
-				false,   // noLocal
-				false,   // noWait
-				nil,     // arguments
+				c.queueCfg.Name,   // name
+				c.ctag,            // consumerTag,
+				c.options.AutoAck, // autoAck
+				false,             // exclusive
+				false,             // noLocal
+				false,             // noWait
+				nil,               // arguments
 			)
 			if err != nil {
 				c.logger.Errorf("deliver channel failed; error = %v", err)
@@ -93,20 +235,149 @@ func (c *Consumer) handle() {
 				c.client = nil
 				continue
 			}
-			if err := d.Ack(false); err != nil {
+			if c.handler != nil {
+				if !c.dispatch(d) {
+					_ = c.client.close()
+					c.client = nil
+				}
+				continue
+			}
+			if c.options.AutoAck {
+				select {
+				case c.manualChan <- newDelivery(d):
+				case <-c.quit:
+				}
+				continue
+			}
+			if !c.awaitAck(d) {
 				_ = c.client.close()
 				c.client = nil
-				continue
 			}
-			c.sendChan <- d
 
 		case <-c.quit:
-			close(c.sendChan)
+			err := c.drain(deliveries)
+			close(c.manualChan)
+			c.shutdownDone <- err
 			return
 		}
 	}
 }
 
+// drain cancels server-side delivery, then forwards every delivery still in
+// flight on deliveries, until deliveries is closed or c.shutdownCtx expires:
+// through the handler if one is registered, otherwise onto manualChan. In
+// manual-ack mode without a handler it does not wait for the caller to
+// settle a delivery before forwarding the next. It returns the first non-nil error
+// encountered while cancelling delivery or closing the channel/connection.
+func (c *Consumer) drain(deliveries <-chan amqp.Delivery) error {
+	if c.client == nil {
+		return nil
+	}
+
+	var firstErr error
+	if err := c.client.channel.Cancel(c.ctag, false); err != nil {
+		c.logger.Errorf("cancel consumer tag '%s' failed; error = %v", c.ctag, err)
+		firstErr = err
+	}
+
+drain:
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				break drain
+			}
+			if c.handler != nil {
+				c.dispatch(d)
+				continue
+			}
+			select {
+			case c.manualChan <- newDelivery(d):
+			case <-c.shutdownCtx.Done():
+				break drain
+			}
+		case <-c.shutdownCtx.Done():
+			break drain
+		}
+	}
+
+	if err := c.client.channel.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := c.client.connection.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// dispatch runs the delivery through c.handler (installed via Handle/Use).
+// In manual-ack mode the delivery is Ack'd on a nil error and Nack'd with
+// requeue otherwise; in auto-ack mode the broker has already settled the
+// delivery, so a handler error is only logged. It returns false if the
+// underlying channel/connection should be recycled.
+func (c *Consumer) dispatch(d amqp.Delivery) bool {
+	err := c.handler(context.Background(), d)
+	if c.options.AutoAck {
+		if err != nil {
+			c.logger.Errorf("delivery handler failed; error = %v", err)
+		}
+		return true
+	}
+
+	if err != nil {
+		if nackErr := d.Nack(false, true); nackErr != nil {
+			c.logger.Errorf("requeue after handler error failed; error = %v", nackErr)
+			return false
+		}
+		return true
+	}
+	if ackErr := d.Ack(false); ackErr != nil {
+		c.logger.Errorf("ack after handler success failed; error = %v", ackErr)
+		return false
+	}
+	return true
+}
+
+// awaitAck hands the delivery to the caller in manual-ack mode and blocks
+// until the caller calls Ack, Nack or Reject on it, or c.options.AckTimeout
+// elapses first, in which case it is Nack'd with requeue on the caller's
+// behalf. It returns false if the underlying channel/connection should be
+// recycled.
+func (c *Consumer) awaitAck(d amqp.Delivery) bool {
+	delivery := newDelivery(d)
+
+	select {
+	case c.manualChan <- delivery:
+	case <-c.quit:
+		return true
+	}
+
+	if c.options.AckTimeout <= 0 {
+		select {
+		case <-delivery.Settled():
+		case <-c.quit:
+		}
+		return true
+	}
+
+	timer := time.NewTimer(c.options.AckTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-delivery.Settled():
+		return true
+	case <-timer.C:
+		c.logger.Warnf("ack timeout after %s on delivery tag %d; requeueing", c.options.AckTimeout, d.DeliveryTag)
+		if err := d.Nack(false, true); err != nil {
+			c.logger.Errorf("requeue on ack timeout failed; error = %v", err)
+			return false
+		}
+		return true
+	case <-c.quit:
+		return true
+	}
+}
+
 func redialConsumer(ctx context.Context, con *Consumer) chan chan *client {
 	clientChanChan := make(chan chan *client)
 
@@ -153,43 +424,39 @@ func redialConsumer(ctx context.Context, con *Consumer) chan chan *client {
 				return
 			}
 
-			con.logger.Debugf("Declaring Exchange (%s)", con.exchange)
-			if err = c.channel.ExchangeDeclare(
-				con.exchange,     // name of the exchange
-				con.exchangeType, // type
-				true,             // durable
-				false,            // delete when complete
-				false,            // internal
-				false,            // noWait
-				nil,              // arguments
-			); err != nil {
-				con.logger.Errorf("declare exchange failed; error = %v", err)
+			if ctx.Err() != nil {
+				con.logger.Errorf("context done before declaring exchange; error = %v", ctx.Err())
+				_ = c.close()
 				return
 			}
+			for _, exchangeCfg := range con.exchangeCfgs {
+				con.logger.Debugf("Declaring Exchange (%s)", exchangeCfg.Name)
+				if err = declareExchange(c.channel, exchangeCfg); err != nil {
+					con.logger.Errorf("declare exchange '%s' failed; error = %v", exchangeCfg.Name, err)
+					return
+				}
+			}
 
-			con.logger.Debugf("Declaring Queue (%s)", con.queue)
-			state, err := c.channel.QueueDeclare(
-				con.queue, // name of the queue
-				true,      // durable
-				false,     // delete when usused
-				false,     // exclusive
-				false,     // noWait
-				nil,       // arguments
-			)
+			if ctx.Err() != nil {
+				con.logger.Errorf("context done before declaring queue; error = %v", ctx.Err())
+				_ = c.close()
+				return
+			}
+			con.logger.Debugf("Declaring Queue (%s)", con.queueCfg.Name)
+			state, err := declareQueue(c.channel, con.queueCfg)
 			if err != nil {
 				con.logger.Errorf("declare queue failed; error = %v", err)
 				return
 			}
 
-			con.logger.Debugf("Declared Queue (%d messages, %d consumers), binding to Exchange (key '%s')",
-				state.Messages, state.Consumers, con.routingKey)
-			if err = c.channel.QueueBind(
-				con.queue,      // name of the queue
-				con.routingKey, // routingKey
-				con.exchange,   // sourceExchange
-				false,          // noWait
-				nil,            // arguments
-			); err != nil {
+			if ctx.Err() != nil {
+				con.logger.Errorf("context done before binding queue; error = %v", ctx.Err())
+				_ = c.close()
+				return
+			}
+			con.logger.Debugf("Declared Queue (%d messages, %d consumers), binding to %d exchange(s)",
+				state.Messages, state.Consumers, len(con.bindings))
+			if err = bindQueue(c.channel, con.queueCfg.Name, con.bindings); err != nil {
 				con.logger.Errorf("bind queue failed; error = %v", err)
 				return
 			}
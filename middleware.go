@@ -0,0 +1,48 @@
+package amqclient
+
+import (
+	"context"
+	"github.com/streadway/amqp"
+)
+
+// DeliveryHandler processes a single delivery. Returning a non-nil error in
+// manual-ack mode causes the delivery to be Nack'd with requeue; returning
+// nil Acks it. In auto-ack mode the return value is only logged.
+type DeliveryHandler func(ctx context.Context, d amqp.Delivery) error
+
+// Middleware wraps a DeliveryHandler to add cross-cutting behaviour such as
+// tracing, metrics or recovery.
+type Middleware func(DeliveryHandler) DeliveryHandler
+
+// PublishHandler publishes a single message. Middleware may mutate msg
+// (e.g. to inject trace headers) before calling the next handler in chain.
+type PublishHandler func(ctx context.Context, routingKey string, msg amqp.Publishing) error
+
+// PublishMiddleware wraps a PublishHandler.
+type PublishMiddleware func(PublishHandler) PublishHandler
+
+// Use registers middleware that wraps Handle's handler, in the order given;
+// the first middleware is the outermost. Use must be called before Handle.
+func (c *Consumer) Use(mw ...Middleware) {
+	c.middlewares = append(c.middlewares, mw...)
+}
+
+// Handle registers h as the handler invoked for every delivery, wrapped by
+// any middleware previously passed to Use. Registering a handler opts the
+// Consumer into the middleware chain; deliveries are no longer pushed onto
+// the manualChan returned by NewConsumer/NewConsumerWithOptions.
+func (c *Consumer) Handle(h DeliveryHandler) {
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		h = c.middlewares[i](h)
+	}
+	c.handler = h
+}
+
+// Use registers middleware that wraps Publish's handler, in the order
+// given; the first middleware is the outermost. Unlike Consumer, Producer
+// has no separate Handle call: every Use is appended to p.middlewares and
+// the chain is rebuilt from enqueue on every Publish, so calls to Use
+// compose instead of overwriting one another.
+func (p *Producer) Use(mw ...PublishMiddleware) {
+	p.middlewares = append(p.middlewares, mw...)
+}
@@ -0,0 +1,367 @@
+package amqclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+	"net"
+	"time"
+)
+
+// DeadLetter describes a publishing that could not be confirmed after
+// retrying, along with the reason it was abandoned.
+type DeadLetter struct {
+	RoutingKey string
+	Publishing amqp.Publishing
+	Reason     string
+}
+
+// DeadLetterFunc is invoked for every DeadLetter: a publishing that was
+// returned by the broker (NotifyReturn), nack'd or lost across redials more
+// than MaxRetries times in total, or that could not be requeued because the
+// retry buffer was full.
+type DeadLetterFunc func(DeadLetter)
+
+// ProducerOptions configures confirm-mode publishing, retry behaviour and
+// dead-letter handling for a Producer.
+type ProducerOptions struct {
+	MaxRetries     int
+	RetryBuffer    int
+	DeadLetterFunc DeadLetterFunc
+	DLXExchange    string
+	DLXRoutingKey  string
+}
+
+// DefaultProducerOptions returns sane defaults: three retries, a retry
+// buffer of 64 pending publishings, and no dead-letter routing.
+func DefaultProducerOptions() ProducerOptions {
+	return ProducerOptions{
+		MaxRetries:  3,
+		RetryBuffer: 64,
+	}
+}
+
+type pendingPublishing struct {
+	routingKey string
+	publishing amqp.Publishing
+	retries    int
+	result     chan error
+}
+
+type Producer struct {
+	amqpURI        string
+	tls            *tls.Config
+	exchange       string
+	exchangeType   string
+	options        ProducerOptions
+	logger         *zap.SugaredLogger
+	client         *client
+	clientChanChan chan chan *client
+	returns        <-chan amqp.Return
+	publishChan    chan *pendingPublishing
+	retryChan      chan *pendingPublishing
+	middlewares    []PublishMiddleware
+	cancel         context.CancelFunc
+	quit           chan struct{}
+}
+
+// NewProducer dials amqpURI, declares exchange/exchangeType the same way
+// NewConsumer does, puts the channel into confirm mode and returns a
+// Producer ready to Publish. The returned Producer redials on connection
+// loss and replays any publishings that had not yet been confirmed.
+func NewProducer(amqpURI string, tls *tls.Config, exchange string, exchangeType string, logger *zap.SugaredLogger,
+	opts ProducerOptions) (*Producer, error) {
+
+	p := &Producer{
+		amqpURI:      amqpURI,
+		tls:          tls,
+		exchange:     exchange,
+		exchangeType: exchangeType,
+		options:      opts,
+		logger:       logger,
+		publishChan:  make(chan *pendingPublishing),
+		retryChan:    make(chan *pendingPublishing, opts.RetryBuffer),
+		quit:         make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.clientChanChan = redialProducer(ctx, p)
+
+	go p.handle()
+	return p, nil
+}
+
+// Publish sends msg with routingKey and blocks until the broker acks the
+// publishing, the publishing is dead-lettered (a nack, a return or a lost
+// connection is retried up to MaxRetries times), or ctx is done. If middleware has been registered via Use, msg is routed
+// through the middleware chain (outermost first) before being enqueued.
+func (p *Producer) Publish(ctx context.Context, routingKey string, msg amqp.Publishing) error {
+	h := PublishHandler(p.enqueue)
+	for i := len(p.middlewares) - 1; i >= 0; i-- {
+		h = p.middlewares[i](h)
+	}
+	return h(ctx, routingKey, msg)
+}
+
+// enqueue is the innermost PublishHandler: it hands the publishing to the
+// handle goroutine and blocks for the result.
+func (p *Producer) enqueue(ctx context.Context, routingKey string, msg amqp.Publishing) error {
+	pp := &pendingPublishing{
+		routingKey: routingKey,
+		publishing: msg,
+		result:     make(chan error, 1),
+	}
+
+	select {
+	case p.publishChan <- pp:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.quit:
+		return fmt.Errorf("producer is shut down")
+	}
+
+	select {
+	case err := <-pp.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Producer) Shutdown() {
+	p.logger.Warn("producer received shutdown ...")
+	close(p.quit)
+	p.cancel()
+}
+
+func (p *Producer) handle() {
+	for {
+		if p.client == nil {
+			clientChan, ok := <-p.clientChanChan
+			if !ok {
+				p.logger.Errorf("cannot get a new client; channel is closed")
+				return
+			}
+			p.client = <-clientChan
+			p.replayPending()
+		}
+
+		select {
+		case pp := <-p.retryChan:
+			p.publish(pp)
+
+		case pp := <-p.publishChan:
+			p.publish(pp)
+
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// replayPending drains the retry buffer through the freshly (re)dialed
+// client, used right after a redial.
+func (p *Producer) replayPending() {
+	for {
+		select {
+		case pp := <-p.retryChan:
+			p.publish(pp)
+		default:
+			return
+		}
+	}
+}
+
+func (p *Producer) publish(pp *pendingPublishing) {
+	if p.client == nil {
+		p.requeueOrDeadLetter(pp, "no client available")
+		return
+	}
+
+	if err := p.client.channel.Publish(
+		p.exchange,
+		pp.routingKey,
+		true,  // mandatory, so unroutable messages are returned via NotifyReturn
+		false, // immediate
+		pp.publishing,
+	); err != nil {
+		p.logger.Errorf("publish failed; error = %v", err)
+		_ = p.client.close()
+		p.client = nil
+		p.requeueOrDeadLetter(pp, err.Error())
+		return
+	}
+
+	// The broker sends basic.return (if any) before the matching
+	// basic.ack/basic.nack for the same publishing, so loop until the
+	// confirm arrives, remembering any return seen along the way.
+	var returned *amqp.Return
+	for {
+		select {
+		case r, ok := <-p.returns:
+			if !ok {
+				p.returns = nil
+				continue
+			}
+			ret := r
+			returned = &ret
+			p.logger.Warnf("message returned by broker; exchange = %s, routingKey = %s, reason = %s",
+				ret.Exchange, ret.RoutingKey, ret.ReplyText)
+
+		case confirm, ok := <-p.client.confirms:
+			if !ok {
+				p.logger.Error("confirms channel closed")
+				_ = p.client.close()
+				p.client = nil
+				p.requeueOrDeadLetter(pp, "confirms channel closed")
+				return
+			}
+
+			// The return and its confirm can both be ready at once and select
+			// picks between them at random, so check for a return once more.
+			if returned == nil {
+				select {
+				case r, ok := <-p.returns:
+					if ok {
+						ret := r
+						returned = &ret
+					}
+				default:
+				}
+			}
+			if returned != nil {
+				p.requeueOrDeadLetter(pp, fmt.Sprintf("returned; reply = %d %s", returned.ReplyCode, returned.ReplyText))
+				return
+			}
+			if !confirm.Ack {
+				p.requeueOrDeadLetter(pp, "broker nack'd publishing")
+				return
+			}
+
+			pp.result <- nil
+			return
+		}
+	}
+}
+
+func (p *Producer) requeueOrDeadLetter(pp *pendingPublishing, reason string) {
+	pp.retries++
+	if pp.retries <= p.options.MaxRetries {
+		select {
+		case p.retryChan <- pp:
+			return
+		default:
+			p.logger.Warnf("retry buffer full, dead-lettering routing key '%s'", pp.routingKey)
+		}
+	}
+
+	p.deadLetter(pp, reason)
+	pp.result <- fmt.Errorf("publish to '%s' failed after %d retries; reason = %s", pp.routingKey, pp.retries-1, reason)
+}
+
+func (p *Producer) deadLetter(pp *pendingPublishing, reason string) {
+	dl := DeadLetter{
+		RoutingKey: pp.routingKey,
+		Publishing: pp.publishing,
+		Reason:     reason,
+	}
+
+	if p.options.DeadLetterFunc != nil {
+		p.options.DeadLetterFunc(dl)
+	}
+
+	if p.options.DLXExchange == "" || p.client == nil {
+		return
+	}
+
+	routingKey := p.options.DLXRoutingKey
+	if routingKey == "" {
+		routingKey = pp.routingKey
+	}
+	if err := p.client.channel.Publish(p.options.DLXExchange, routingKey, false, false, pp.publishing); err != nil {
+		p.logger.Errorf("publish to dead-letter exchange '%s' failed; error = %v", p.options.DLXExchange, err)
+	}
+}
+
+func redialProducer(ctx context.Context, p *Producer) chan chan *client {
+	clientChanChan := make(chan chan *client)
+
+	go func() {
+		clientChan := make(chan *client)
+		defer close(clientChanChan)
+		defer close(clientChan)
+
+		for {
+			select {
+			case clientChanChan <- clientChan:
+			case <-ctx.Done():
+				p.logger.Errorf("context done; error = %v", ctx.Done())
+				return
+			}
+
+			var err error
+			c := &client{
+				connection: nil,
+				channel:    nil,
+				confirms:   nil,
+			}
+			p.logger.Debugf("Connecting to %s", p.amqpURI)
+			cfg := amqp.Config{
+				Heartbeat: 10 * time.Second,
+				Dial: func(nw string, addr string) (net.Conn, error) {
+					return net.DialTimeout(nw, addr, 10*time.Second)
+				},
+			}
+			if p.tls != nil {
+				cfg.TLSClientConfig = p.tls
+			}
+
+			c.connection, err = amqp.DialConfig(p.amqpURI, cfg)
+			if err != nil {
+				p.logger.Errorf("dial %s failed; error = %v ", p.amqpURI, err)
+				return
+			}
+
+			p.logger.Debug("Getting Channel")
+			c.channel, err = c.connection.Channel()
+			if err != nil {
+				p.logger.Errorf("get channel failed; error = %v", err)
+				return
+			}
+
+			p.logger.Debugf("Declaring Exchange (%s)", p.exchange)
+			if err = c.channel.ExchangeDeclare(
+				p.exchange,     // name of the exchange
+				p.exchangeType, // type
+				true,           // durable
+				false,          // delete when complete
+				false,          // internal
+				false,          // noWait
+				nil,            // arguments
+			); err != nil {
+				p.logger.Errorf("declare exchange failed; error = %v", err)
+				return
+			}
+
+			p.logger.Debug("Putting channel into confirm mode")
+			if err = c.channel.Confirm(false); err != nil {
+				p.logger.Errorf("put channel into confirm mode failed; error = %v", err)
+				return
+			}
+			c.confirms = c.channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+			p.returns = c.channel.NotifyReturn(make(chan amqp.Return, 1))
+
+			select {
+			case clientChan <- c:
+			case <-ctx.Done():
+				p.logger.Errorf("context done; error = %v", ctx.Err())
+				return
+			}
+		}
+	}()
+
+	return clientChanChan
+}
@@ -0,0 +1,111 @@
+package amqclient
+
+import "github.com/streadway/amqp"
+
+// ExchangeConfig describes the exchange a Consumer declares (or expects to
+// already exist, when Passive is set) before it binds its queue.
+type ExchangeConfig struct {
+	Name       string
+	Type       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	Passive    bool
+	Args       amqp.Table
+}
+
+// QueueConfig describes the queue a Consumer declares (or expects to
+// already exist, when Passive is set). Args is where broker-specific
+// behaviour such as quorum/stream queues (x-queue-type), dead-lettering
+// (x-dead-letter-exchange), message TTL (x-message-ttl) or max length
+// (x-max-length) is configured.
+type QueueConfig struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Passive    bool
+	Args       amqp.Table
+}
+
+// Binding binds a Consumer's queue to Exchange with RoutingKey. A Consumer
+// may declare multiple Bindings, e.g. to subscribe to several routing keys
+// on a topic exchange or to several exchanges entirely.
+type Binding struct {
+	Exchange   string
+	RoutingKey string
+	Args       amqp.Table
+}
+
+// DefaultExchangeConfig returns a durable, non-autodelete, active (not
+// passive) exchange config, matching NewConsumer's historical behaviour.
+func DefaultExchangeConfig(name string, kind string) ExchangeConfig {
+	return ExchangeConfig{
+		Name:    name,
+		Type:    kind,
+		Durable: true,
+	}
+}
+
+// DefaultQueueConfig returns a durable, non-autodelete, non-exclusive,
+// active (not passive) queue config, matching NewConsumer's historical
+// behaviour.
+func DefaultQueueConfig(name string) QueueConfig {
+	return QueueConfig{
+		Name:    name,
+		Durable: true,
+	}
+}
+
+func declareExchange(channel *amqp.Channel, cfg ExchangeConfig) error {
+	if cfg.Passive {
+		return channel.ExchangeDeclarePassive(
+			cfg.Name,
+			cfg.Type,
+			cfg.Durable,
+			cfg.AutoDelete,
+			cfg.Internal,
+			false, // noWait
+			cfg.Args,
+		)
+	}
+	return channel.ExchangeDeclare(
+		cfg.Name,
+		cfg.Type,
+		cfg.Durable,
+		cfg.AutoDelete,
+		cfg.Internal,
+		false, // noWait
+		cfg.Args,
+	)
+}
+
+func declareQueue(channel *amqp.Channel, cfg QueueConfig) (amqp.Queue, error) {
+	if cfg.Passive {
+		return channel.QueueDeclarePassive(
+			cfg.Name,
+			cfg.Durable,
+			cfg.AutoDelete,
+			cfg.Exclusive,
+			false, // noWait
+			cfg.Args,
+		)
+	}
+	return channel.QueueDeclare(
+		cfg.Name,
+		cfg.Durable,
+		cfg.AutoDelete,
+		cfg.Exclusive,
+		false, // noWait
+		cfg.Args,
+	)
+}
+
+func bindQueue(channel *amqp.Channel, queue string, bindings []Binding) error {
+	for _, b := range bindings {
+		if err := channel.QueueBind(queue, b.RoutingKey, b.Exchange, false, b.Args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
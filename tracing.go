@@ -0,0 +1,77 @@
+package amqclient
+
+import (
+	"context"
+	"github.com/streadway/amqp"
+)
+
+// traceHeaders lists the header keys TracingMiddleware reads from, in
+// priority order: W3C traceparent first, then the
+// Jaeger/OpenTracing uber-trace-id header, then the OpenTracing binary carrier.
+var traceHeaders = []string{"traceparent", "uber-trace-id", "opentracing-span-binary"}
+
+type spanContextKey struct{}
+
+// Span is a minimal carrier for the trace context propagated across a
+// delivery or publishing. It intentionally does not depend on a specific
+// tracing SDK; callers that need a real span can pass Header and Value to
+// their own tracer and start one from it.
+type Span struct {
+	// Header is the name of the header the trace context was read from
+	// (or will be written to), e.g. "traceparent".
+	Header string
+	// Value is the raw header value.
+	Value string
+}
+
+// SpanFromContext returns the Span stored by TracingMiddleware, if any.
+func SpanFromContext(ctx context.Context) (*Span, bool) {
+	span, ok := ctx.Value(spanContextKey{}).(*Span)
+	return span, ok
+}
+
+// TracingMiddleware extracts the first recognised trace header out of
+// d.Headers, stores it on the context as a *Span via SpanFromContext, and
+// invokes next. It is a no-op if none of traceHeaders is present.
+func TracingMiddleware() Middleware {
+	return func(next DeliveryHandler) DeliveryHandler {
+		return func(ctx context.Context, d amqp.Delivery) error {
+			if span := extractSpan(d.Headers); span != nil {
+				ctx = context.WithValue(ctx, spanContextKey{}, span)
+			}
+			return next(ctx, d)
+		}
+	}
+}
+
+// TracingPublishMiddleware injects the *Span previously stored on ctx by
+// TracingMiddleware into msg.Headers before
+// calling next, so trace context survives the hop across the exchange.
+func TracingPublishMiddleware() PublishMiddleware {
+	return func(next PublishHandler) PublishHandler {
+		return func(ctx context.Context, routingKey string, msg amqp.Publishing) error {
+			if span, ok := SpanFromContext(ctx); ok {
+				if msg.Headers == nil {
+					msg.Headers = amqp.Table{}
+				}
+				msg.Headers[span.Header] = span.Value
+			}
+			return next(ctx, routingKey, msg)
+		}
+	}
+}
+
+func extractSpan(headers amqp.Table) *Span {
+	for _, name := range traceHeaders {
+		v, ok := headers[name]
+		if !ok {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		return &Span{Header: name, Value: s}
+	}
+	return nil
+}